@@ -0,0 +1,114 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// Package migrations is the coordinator-side home for cluster version
+// migrations: what runs when the cluster version advances past a given
+// version, what (if anything) can undo that, and what has to be true of the
+// cluster before it's safe to advance at all. pkg/server's migrationServer
+// drives these registrations; it doesn't define them.
+package migrations
+
+import (
+	"context"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/kv"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+)
+
+// Registration ties a migration to the cluster version it runs at.
+type Registration struct {
+	// Version is the cluster version that, once active, triggers this
+	// migration.
+	Version roachpb.Version
+
+	// Rollback, if non-nil, undoes whatever this migration did, making it
+	// safe for RollbackClusterVersion to step the cluster version back below
+	// Version. A migration that can't be undone -- for instance, one that
+	// has already deleted data the prior version's code depends on -- leaves
+	// this nil, which blocks any rollback attempt that would cross it.
+	Rollback func(ctx context.Context) error
+}
+
+// UpgradePrecondition is a registered check that must pass before a cluster
+// is allowed to advance to Version. Unlike a hard compatibility check,
+// failing a precondition doesn't make the upgrade impossible, just
+// inadvisable until the operator resolves it; PrecheckClusterVersion
+// surfaces failures as findings rather than failing outright.
+type UpgradePrecondition struct {
+	// Version is the cluster version this precondition guards.
+	Version roachpb.Version
+
+	// Check reports whether the precondition is currently unmet, along with
+	// a human-readable reason.
+	Check func(ctx context.Context, db *kv.DB) (blocked bool, reason string)
+
+	// Remediation is a human-readable description of how to resolve the
+	// finding, surfaced alongside Check's reason.
+	Remediation string
+}
+
+var (
+	registeredMigrations    []Registration
+	registeredPreconditions []UpgradePrecondition
+)
+
+// Register adds a migration to the registry. It's called from init()
+// functions in the individual migration files, one per cluster version.
+func Register(r Registration) {
+	registeredMigrations = append(registeredMigrations, r)
+}
+
+// RegisterUpgradePrecondition adds an upgrade precondition to the registry.
+func RegisterUpgradePrecondition(p UpgradePrecondition) {
+	registeredPreconditions = append(registeredPreconditions, p)
+}
+
+// RegisteredMigrations returns every registered migration whose version
+// falls in (from, to], the same half-open window BumpClusterVersion steps
+// through when moving forward, ordered from oldest to newest.
+func RegisteredMigrations(from, to roachpb.Version) []Registration {
+	var out []Registration
+	for _, r := range registeredMigrations {
+		if from.Less(r.Version) && !to.Less(r.Version) {
+			out = append(out, r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version.Less(out[j].Version) })
+	return out
+}
+
+// RegisteredUpgradePreconditions returns every precondition registered for a
+// version up to and including target.
+func RegisteredUpgradePreconditions(target roachpb.Version) []UpgradePrecondition {
+	var out []UpgradePrecondition
+	for _, p := range registeredPreconditions {
+		if !target.Less(p.Version) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// QuorumCommittedClusterVersion is consulted during startup to reconcile a
+// cluster version staged by PrepareClusterVersion that a crash left
+// uncommitted: if it reports that a quorum of nodes already durably
+// committed version v, we roll forward rather than come back up on a stale
+// version. It doesn't contact any other node: it always reports false, so a
+// restarting node discards its stage and never rolls forward.
+func QuorumCommittedClusterVersion(ctx context.Context, db *kv.DB, v roachpb.Version) (bool, error) {
+	// TODO(irfansharif): Fan this out to live nodes via the migrations
+	// coordinator's node liveness view, the same way the coordinator itself
+	// polls for PrepareClusterVersion/CommitClusterVersion acks. Until that
+	// plumbing lands here, a restarting node conservatively assumes no
+	// quorum committed and discards its stage rather than risk activating a
+	// version the rest of the cluster hasn't agreed to.
+	return false, nil
+}
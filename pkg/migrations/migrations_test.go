@@ -0,0 +1,70 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package migrations
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/stretchr/testify/require"
+)
+
+func v(minor int32) roachpb.Version {
+	return roachpb.Version{Major: 22, Minor: minor}
+}
+
+func TestRegisteredMigrationsOrdersByVersion(t *testing.T) {
+	defer func() { registeredMigrations = nil }()
+
+	Register(Registration{Version: v(3), Rollback: func(context.Context) error { return nil }})
+	Register(Registration{Version: v(1), Rollback: func(context.Context) error { return nil }})
+	Register(Registration{Version: v(2), Rollback: func(context.Context) error { return nil }})
+
+	got := RegisteredMigrations(v(0), v(3))
+	require.Len(t, got, 3)
+	require.Equal(t, []roachpb.Version{v(1), v(2), v(3)}, []roachpb.Version{got[0].Version, got[1].Version, got[2].Version})
+}
+
+func TestRegisteredMigrationsExcludesOutOfWindow(t *testing.T) {
+	defer func() { registeredMigrations = nil }()
+
+	Register(Registration{Version: v(1)})
+	Register(Registration{Version: v(2)})
+	Register(Registration{Version: v(3)})
+
+	got := RegisteredMigrations(v(1), v(2))
+	require.Len(t, got, 1)
+	require.Equal(t, v(2), got[0].Version)
+}
+
+func TestRegisteredMigrationsSurfacesNonRollbackSafeEntries(t *testing.T) {
+	defer func() { registeredMigrations = nil }()
+
+	Register(Registration{Version: v(1), Rollback: func(context.Context) error { return nil }})
+	Register(Registration{Version: v(2), Rollback: nil})
+
+	got := RegisteredMigrations(v(0), v(2))
+	require.Len(t, got, 2)
+	require.NotNil(t, got[0].Rollback)
+	require.Nil(t, got[1].Rollback)
+}
+
+func TestRegisteredUpgradePreconditionsIncludesEverythingUpToTarget(t *testing.T) {
+	defer func() { registeredPreconditions = nil }()
+
+	RegisterUpgradePrecondition(UpgradePrecondition{Version: v(1), Remediation: "a"})
+	RegisterUpgradePrecondition(UpgradePrecondition{Version: v(2), Remediation: "b"})
+	RegisterUpgradePrecondition(UpgradePrecondition{Version: v(3), Remediation: "c"})
+
+	got := RegisteredUpgradePreconditions(v(2))
+	require.Len(t, got, 2)
+}
@@ -12,17 +12,107 @@ package server
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/clusterversion"
 	"github.com/cockroachdb/cockroach/pkg/kv/kvserver"
+	"github.com/cockroachdb/cockroach/pkg/migrations"
 	"github.com/cockroachdb/cockroach/pkg/server/serverpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/redact"
 )
 
+// trustedMigrationKeys holds the set of public keys (PEM-encoded, comma
+// separated) that every mutating migration RPC (and ValidateTargetClusterVersion)
+// accepts signatures from. An operator populates this before a signed
+// upgrade tool can drive a version bump; an unsigned or badly-signed
+// request is rejected once this setting is non-empty.
+var trustedMigrationKeys = settings.RegisterStringSetting(
+	"server.migration.trusted_keys",
+	"PEM-encoded, comma-separated Ed25519 public keys allowed to sign cluster version bump requests; "+
+		"if empty, signature verification is skipped",
+	"",
+).WithPublic()
+
+// migrationSignaturePayload is the canonical, order-fixed encoding that a
+// migration signer signs over. Binding the cluster ID and both versions into
+// the payload prevents a captured signature from being replayed against a
+// different cluster or a different version transition.
+func migrationSignaturePayload(clusterID, fromVersion, toVersion, nonce string) []byte {
+	return []byte(fmt.Sprintf("%s|%s|%s|%s", clusterID, fromVersion, toVersion, nonce))
+}
+
+// verifyMigrationSignature checks sig (over payload) against every trusted
+// key configured in server.migration.trusted_keys, accepting it if any key
+// verifies it (keyID doesn't select a key; it names the signer in errors and
+// scopes the nonce), and then consumes nonce so the very same signed request can't be replayed a second
+// time -- binding the cluster ID and both versions into the payload only
+// stops a signature from being repurposed for a *different* transition, not
+// from being replayed against this one. Consumed nonces are durably
+// recorded on engines so the check holds across a restart. It returns nil
+// without touching the nonce store if the setting is empty, since an
+// operator who hasn't configured any trusted keys hasn't opted into this
+// defense.
+func verifyMigrationSignature(
+	ctx context.Context,
+	engines []storage.Engine,
+	sv *settings.Values,
+	keyID, nonce string,
+	payload, sig []byte,
+) error {
+	raw := trustedMigrationKeys.Get(sv)
+	if raw == "" {
+		return nil
+	}
+
+	verified := false
+	for _, block := range strings.Split(raw, ",") {
+		p, _ := pem.Decode([]byte(strings.TrimSpace(block)))
+		if p == nil {
+			continue
+		}
+		// Trusted keys are stored as standard PKIX "PUBLIC KEY" PEM blocks
+		// (e.g. as produced by `openssl genpkey -algorithm ed25519` or
+		// x509.MarshalPKIXPublicKey), not raw Ed25519 key bytes.
+		parsed, err := x509.ParsePKIXPublicKey(p.Bytes)
+		if err != nil {
+			continue
+		}
+		pub, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			continue
+		}
+		if ed25519.Verify(pub, payload, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.Newf("%s", redact.Safe(fmt.Sprintf("signature from key %q does not verify against any trusted key", keyID)))
+	}
+
+	firstUse, err := kvserver.ConsumeMigrationNonce(ctx, engines, keyID, nonce)
+	if err != nil {
+		return err
+	}
+	if !firstUse {
+		return errors.Newf("%s", redact.Safe(fmt.Sprintf(
+			"nonce %q for key %q has already been consumed by a prior request; rejecting possible replay", nonce, keyID)))
+	}
+
+	return nil
+}
+
 // migrationServer is an implementation of the Migration service. The RPCs here
 // are used to power the migrations infrastructure in pkg/migrations.
 type migrationServer struct {
@@ -34,6 +124,20 @@ type migrationServer struct {
 
 var _ serverpb.MigrationServer = &migrationServer{}
 
+// newMigrationServer constructs the Migration service and reconciles any
+// cluster version staged by a prior PrepareClusterVersion that a crash left
+// uncommitted, before the returned server is wired up to start accepting
+// RPCs. Server.Start calls this while bringing up the RPC server, ahead of
+// registering it with the gRPC server or serving any traffic, so that no
+// migration RPC can observe a stale stage left behind by the crash.
+func newMigrationServer(ctx context.Context, s *Server) (*migrationServer, error) {
+	m := &migrationServer{server: s}
+	if err := m.ReconcileStagedClusterVersion(ctx); err != nil {
+		return nil, errors.Wrap(err, "reconciling staged cluster version at startup")
+	}
+	return m, nil
+}
+
 // ValidateTargetClusterVersion implements the MigrationServer interface.
 // It's used to verify that we're running a binary that's able to support the
 // given cluster version.
@@ -43,6 +147,23 @@ func (m *migrationServer) ValidateTargetClusterVersion(
 	targetVersion := *req.Version
 	versionSetting := m.server.ClusterSettings().Version
 
+	// Derive the "from" version the same way every other RPC in this file
+	// does, rather than trusting req.FromVersion: a client can't be allowed
+	// to pick what it claims the signed transition started from.
+	prevCV, err := kvserver.SynthesizeClusterVersionFromEngines(
+		ctx, m.server.engines, versionSetting.BinaryVersion(),
+		versionSetting.BinaryMinSupportedVersion(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := migrationSignaturePayload(m.server.ClusterID().String(), prevCV.Version.String(), targetVersion.String(), req.Nonce)
+	if err := verifyMigrationSignature(ctx, m.server.engines, &versionSetting.SV, req.KeyId, req.Nonce, payload, req.Signature); err != nil {
+		log.Warningf(ctx, "rejecting unsigned or mis-signed target cluster version: %v", err)
+		return nil, err
+	}
+
 	// We're validating the following:
 	//
 	//   node's minimum supported version <= target version <= node's binary version
@@ -64,12 +185,112 @@ func (m *migrationServer) ValidateTargetClusterVersion(
 	return resp, nil
 }
 
+// PrecheckClusterVersion implements the MigrationServer interface. Unlike
+// ValidateTargetClusterVersion, which only checks that the node's binary can
+// serve the target version, PrecheckClusterVersion looks for *soft* blockers
+// that an operator needs to clear before it's safe to upgrade: things that
+// won't make the bump fail outright, but that make it inadvisable. We
+// collect every finding up front rather than returning on the first one, so
+// `cockroach node upgrade check` can print the full list in one pass.
+func (m *migrationServer) PrecheckClusterVersion(
+	ctx context.Context, req *serverpb.PrecheckClusterVersionRequest,
+) (*serverpb.PrecheckClusterVersionResponse, error) {
+	targetVersion := *req.Version
+	versionSetting := m.server.ClusterSettings().Version
+
+	var findings []*serverpb.ClusterVersionPrecheckFinding
+
+	if n, err := kvserver.CountDeprecatedTableEncodings(ctx, m.server.engines); err != nil {
+		return nil, err
+	} else if n > 0 {
+		findings = append(findings, &serverpb.ClusterVersionPrecheckFinding{
+			Severity:    serverpb.ClusterVersionPrecheckFinding_WARN,
+			Description: fmt.Sprintf("%d table(s) still use a deprecated key encoding", n),
+			Remediation: "run `cockroach debug encoding-migrate` to rewrite affected tables before upgrading",
+		})
+	}
+
+	if n, err := kvserver.CountUnfinishedSchemaChanges(ctx, m.server.db); err != nil {
+		return nil, err
+	} else if n > 0 {
+		findings = append(findings, &serverpb.ClusterVersionPrecheckFinding{
+			Severity:    serverpb.ClusterVersionPrecheckFinding_WARN,
+			Description: fmt.Sprintf("%d schema change(s) are still in flight", n),
+			Remediation: "wait for SHOW JOBS to report these schema changes as succeeded",
+		})
+	}
+
+	if minRF, actualRF, ok := kvserver.ReplicasBelowMinimumReplicationFactor(ctx, m.server.engines, targetVersion); !ok {
+		findings = append(findings, &serverpb.ClusterVersionPrecheckFinding{
+			Severity:    serverpb.ClusterVersionPrecheckFinding_ERROR,
+			Description: fmt.Sprintf("replication factor %d is below the minimum %d required by %s", actualRF, minRF, targetVersion),
+			Remediation: "increase the zone configuration's num_replicas before upgrading",
+		})
+	}
+
+	if lagging, err := kvserver.EnginesWithStaleFormatMajorVersion(ctx, m.server.engines, targetVersion); err != nil {
+		return nil, err
+	} else if len(lagging) > 0 {
+		findings = append(findings, &serverpb.ClusterVersionPrecheckFinding{
+			Severity:    serverpb.ClusterVersionPrecheckFinding_WARN,
+			Description: fmt.Sprintf("%d engine(s) have not yet adopted the format-major-version required by %s", len(lagging), targetVersion),
+			Remediation: "restart the affected nodes to let Pebble ratchet its format-major-version, then retry",
+		})
+	}
+
+	if low, err := kvserver.EnginesBelowDiskFreeThreshold(ctx, m.server.engines); err != nil {
+		return nil, err
+	} else if len(low) > 0 {
+		findings = append(findings, &serverpb.ClusterVersionPrecheckFinding{
+			Severity:    serverpb.ClusterVersionPrecheckFinding_ERROR,
+			Description: fmt.Sprintf("%d engine(s) are below the disk-free threshold needed to stage the upgrade", len(low)),
+			Remediation: "free up disk space on the affected nodes before upgrading",
+		})
+	}
+
+	for _, precondition := range migrations.RegisteredUpgradePreconditions(targetVersion) {
+		if blocked, reason := precondition.Check(ctx, m.server.db); blocked {
+			findings = append(findings, &serverpb.ClusterVersionPrecheckFinding{
+				Severity:    serverpb.ClusterVersionPrecheckFinding_ERROR,
+				Description: reason,
+				Remediation: precondition.Remediation,
+			})
+		}
+	}
+
+	// Fall back to the hard binary-version check too, surfaced as an error
+	// finding rather than an RPC failure, so callers see it alongside
+	// everything else instead of as a special case.
+	if targetVersion.Less(versionSetting.BinaryMinSupportedVersion()) || versionSetting.BinaryVersion().Less(targetVersion) {
+		findings = append(findings, &serverpb.ClusterVersionPrecheckFinding{
+			Severity:    serverpb.ClusterVersionPrecheckFinding_ERROR,
+			Description: fmt.Sprintf("target version %s is outside this binary's supported range [%s, %s]", targetVersion, versionSetting.BinaryMinSupportedVersion(), versionSetting.BinaryVersion()),
+			Remediation: "install a binary whose supported version range covers the target version",
+		})
+	}
+
+	return &serverpb.PrecheckClusterVersionResponse{Findings: findings}, nil
+}
+
 // BumpClusterVersion implements the MigrationServer interface. It's used to
 // inform us of a cluster version bump. Here we're responsible for durably
 // persisting the cluster version and enabling the corresponding version gates.
-func (m *migrationServer) BumpClusterVersion(
-	ctx context.Context, req *serverpb.BumpClusterVersionRequest,
-) (*serverpb.BumpClusterVersionResponse, error) {
+// bumpClusterVersionStraggler is how long a single engine's persist-and-fsync
+// is allowed to take before we log a warning calling it out as a straggler;
+// it doesn't abort anything, and it doesn't change the progress event, which
+// carries the engine's elapsed time either way.
+const bumpClusterVersionStraggler = 30 * time.Second
+
+// bumpClusterVersion does the actual work of persisting a cluster version
+// bump, reporting each stage through emit as it goes. Both BumpClusterVersion
+// (unary) and BumpClusterVersionStream (streaming) drive this; the streaming
+// form is the one that actually surfaces the progress to a caller; the unary
+// form discards every event, turning one that carries an error into an error.
+func (m *migrationServer) bumpClusterVersion(
+	ctx context.Context,
+	req *serverpb.BumpClusterVersionRequest,
+	emit func(*serverpb.ClusterVersionBumpProgress) error,
+) error {
 	m.Lock()
 	defer m.Unlock()
 
@@ -79,39 +300,369 @@ func (m *migrationServer) BumpClusterVersion(
 		versionSetting.BinaryMinSupportedVersion(),
 	)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	payload := migrationSignaturePayload(m.server.ClusterID().String(), prevCV.Version.String(), req.Version.String(), req.Nonce)
+	if err := verifyMigrationSignature(ctx, m.server.engines, &versionSetting.SV, req.KeyId, req.Nonce, payload, req.Signature); err != nil {
+		log.Warningf(ctx, "rejecting unsigned or mis-signed cluster version bump: %v", err)
+		return err
+	}
+
+	if !prevCV.Version.Less(*req.Version) {
+		// Nothing to do.
+		return emit(&serverpb.ClusterVersionBumpProgress{Stage: serverpb.ClusterVersionBumpProgress_DONE})
 	}
 
 	newCV := clusterversion.ClusterVersion{Version: *req.Version}
 
-	if err := func() error {
-		if !prevCV.Version.Less(*req.Version) {
-			// Nothing to do.
-			return nil
+	// Whenever the version changes, we want to persist that update to
+	// wherever the CRDB process retrieved the initial version from
+	// (typically a collection of storage.Engines), one at a time so we can
+	// report progress and call out a straggler rather than blocking opaquely
+	// until every engine is done.
+	for _, eng := range m.server.engines {
+		start := timeutil.Now()
+		engErr := kvserver.WriteClusterVersionToEngine(ctx, eng, newCV)
+		elapsed := timeutil.Since(start)
+		if elapsed > bumpClusterVersionStraggler {
+			log.Warningf(ctx, "engine %s took %s to persist cluster version %s, exceeding the %s straggler threshold",
+				eng.StoreID(), elapsed, newCV, bumpClusterVersionStraggler)
 		}
 
-		// TODO(irfansharif): We should probably capture this pattern of
-		// "persist the cluster version first" and only then bump the
-		// version setting in a better way.
-
-		// Whenever the version changes, we want to persist that update to
-		// wherever the CRDB process retrieved the initial version from
-		// (typically a collection of storage.Engines).
-		if err := kvserver.WriteClusterVersionToEngines(ctx, m.server.engines, newCV); err != nil {
+		progress := &serverpb.ClusterVersionBumpProgress{
+			Stage:        serverpb.ClusterVersionBumpProgress_PERSISTING,
+			EngineId:     eng.StoreID().String(),
+			BytesWritten: kvserver.ClusterVersionRecordSize,
+			Elapsed:      elapsed,
+		}
+		if engErr != nil {
+			progress.Error = engErr.Error()
+		}
+		if err := emit(progress); err != nil {
 			return err
 		}
+		if engErr != nil {
+			return engErr
+		}
+	}
+
+	// Every engine has durably persisted the new version; it's now safe to
+	// bump the local version gate so this node actually starts enforcing it,
+	// rather than only doing so after its next restart.
+	if err := versionSetting.SetActiveVersion(ctx, newCV); err != nil {
+		return err
+	}
+
+	return emit(&serverpb.ClusterVersionBumpProgress{Stage: serverpb.ClusterVersionBumpProgress_DONE})
+}
 
-		// TODO(irfansharif): We'll eventually want to bump the local version
-		// gate here. On 21.1 nodes we'll no longer be using gossip to propagate
-		// cluster version bumps. We'll still have probably disseminate it
-		// through gossip (do we actually have to?), but we won't listen to it.
-		//
-		//  _ = s.server.ClusterSettings().<...>.SetActiveVersion(ctx, newCV)
+// BumpClusterVersion implements the MigrationServer interface. It's used to
+// inform us of a cluster version bump. Here we're responsible for durably
+// persisting the cluster version and enabling the corresponding version
+// gates. It's kept around as a thin wrapper over bumpClusterVersion, the same
+// code path BumpClusterVersionStream drives, for
+// callers that don't care about intermediate progress and just want the
+// final status.
+func (m *migrationServer) BumpClusterVersion(
+	ctx context.Context, req *serverpb.BumpClusterVersionRequest,
+) (*serverpb.BumpClusterVersionResponse, error) {
+	err := m.bumpClusterVersion(ctx, req, func(p *serverpb.ClusterVersionBumpProgress) error {
+		if p.Error != "" {
+			return errors.Newf("%s", redact.Safe(p.Error))
+		}
 		return nil
-	}(); err != nil {
+	})
+	if err != nil {
 		return nil, err
 	}
 
 	resp := &serverpb.BumpClusterVersionResponse{}
 	return resp, nil
-}
\ No newline at end of file
+}
+
+// BumpClusterVersionStream implements the MigrationServer interface. It's
+// the streaming counterpart to BumpClusterVersion: instead of blocking
+// opaquely until every engine has persisted the new version, it emits a
+// ClusterVersionBumpProgress event per stage and per engine, so the
+// migrations coordinator can render live progress across all nodes and
+// notice an engine straggling on its fsync.
+func (m *migrationServer) BumpClusterVersionStream(
+	req *serverpb.BumpClusterVersionRequest, stream serverpb.MigrationServer_BumpClusterVersionStreamServer,
+) error {
+	return m.bumpClusterVersion(stream.Context(), req, stream.Send)
+}
+
+// ReconcileStagedClusterVersion is the crash-recovery half of the two-phase
+// cluster version bump. newMigrationServer calls it once, while the server is
+// still starting up and before its Migration service is registered to accept
+// any RPCs, to resolve a staged version left behind by a node that crashed
+// between PrepareClusterVersion and CommitClusterVersion (or
+// AbortClusterVersion).
+//
+// If a quorum of the cluster already committed the staged version, we roll
+// forward and finish the commit ourselves, rather than coming back up on a
+// version the rest of the cluster has moved past. Otherwise we discard the
+// stage and come up running the version we had before the crash.
+func (m *migrationServer) ReconcileStagedClusterVersion(ctx context.Context) error {
+	m.Lock()
+	defer m.Unlock()
+
+	stagedCV, ok, err := kvserver.ReadStagedClusterVersionFromEngines(ctx, m.server.engines)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// The common case: nothing staged, nothing to reconcile.
+		return nil
+	}
+
+	versionSetting := m.server.ClusterSettings().Version
+	committed, err := migrations.QuorumCommittedClusterVersion(ctx, m.server.db, stagedCV.Version)
+	if err != nil {
+		return err
+	}
+
+	if committed {
+		log.Infof(ctx, "found cluster version %s staged from before a restart, and a quorum of "+
+			"nodes already committed it; rolling forward", stagedCV.Version)
+		if err := kvserver.ActivateStagedClusterVersionOnEngines(ctx, m.server.engines, stagedCV); err != nil {
+			return err
+		}
+		return versionSetting.SetActiveVersion(ctx, stagedCV)
+	}
+
+	log.Infof(ctx, "found cluster version %s staged from before a restart, but no quorum "+
+		"committed it; discarding the stage", stagedCV.Version)
+	return kvserver.DiscardStagedClusterVersionFromEngines(ctx, m.server.engines)
+}
+
+// PrepareClusterVersion implements the MigrationServer interface. It's the
+// first phase of a two-phase cluster version bump: it validates the target
+// version and durably stages it on every engine, without activating the
+// corresponding version gates. A staged version is inert until a matching
+// CommitClusterVersion (or discarded by AbortClusterVersion); this lets the
+// migrations coordinator in pkg/migrations fan PrepareClusterVersion out to
+// every node, confirm that all of them succeeded, and only then commit.
+func (m *migrationServer) PrepareClusterVersion(
+	ctx context.Context, req *serverpb.PrepareClusterVersionRequest,
+) (*serverpb.PrepareClusterVersionResponse, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	versionSetting := m.server.ClusterSettings().Version
+	prevCV, err := kvserver.SynthesizeClusterVersionFromEngines(
+		ctx, m.server.engines, versionSetting.BinaryVersion(),
+		versionSetting.BinaryMinSupportedVersion(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := migrationSignaturePayload(m.server.ClusterID().String(), prevCV.Version.String(), req.Version.String(), req.Nonce)
+	if err := verifyMigrationSignature(ctx, m.server.engines, &versionSetting.SV, req.KeyId, req.Nonce, payload, req.Signature); err != nil {
+		log.Warningf(ctx, "rejecting unsigned or mis-signed cluster version prepare: %v", err)
+		return nil, err
+	}
+
+	if !prevCV.Version.Less(*req.Version) {
+		// Nothing to do; we're already at or past the target version.
+		return &serverpb.PrepareClusterVersionResponse{}, nil
+	}
+
+	stagedCV := clusterversion.ClusterVersion{Version: *req.Version}
+
+	// Stage the new version on every engine. This writes to a pending file
+	// alongside the active cluster version file; it does not touch the
+	// active file, so a crash between here and CommitClusterVersion leaves
+	// the node running at prevCV.
+	if err := kvserver.WriteStagedClusterVersionToEngines(ctx, m.server.engines, stagedCV); err != nil {
+		return nil, err
+	}
+
+	return &serverpb.PrepareClusterVersionResponse{}, nil
+}
+
+// CommitClusterVersion implements the MigrationServer interface. It's the
+// second phase of the two-phase cluster version bump: it atomically
+// activates a version previously staged by PrepareClusterVersion, by
+// renaming the pending file over the active one, and then bumps the local
+// version gate.
+func (m *migrationServer) CommitClusterVersion(
+	ctx context.Context, req *serverpb.CommitClusterVersionRequest,
+) (*serverpb.CommitClusterVersionResponse, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	versionSetting := m.server.ClusterSettings().Version
+	prevCV, err := kvserver.SynthesizeClusterVersionFromEngines(
+		ctx, m.server.engines, versionSetting.BinaryVersion(),
+		versionSetting.BinaryMinSupportedVersion(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := migrationSignaturePayload(m.server.ClusterID().String(), prevCV.Version.String(), req.Version.String(), req.Nonce)
+	if err := verifyMigrationSignature(ctx, m.server.engines, &versionSetting.SV, req.KeyId, req.Nonce, payload, req.Signature); err != nil {
+		log.Warningf(ctx, "rejecting unsigned or mis-signed cluster version commit: %v", err)
+		return nil, err
+	}
+
+	// Don't trust req.Version as the version to activate: re-derive it from
+	// what's actually staged on disk, so CommitClusterVersion can't be used
+	// to activate a version that was never through PrepareClusterVersion (or
+	// that a concurrent PrepareClusterVersion has since overwritten).
+	stagedCV, ok, err := kvserver.ReadStagedClusterVersionFromEngines(ctx, m.server.engines)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.Newf("%s", redact.Safe("no staged cluster version to commit; call PrepareClusterVersion first"))
+	}
+	if stagedCV.Version != *req.Version {
+		return nil, errors.Newf("%s", redact.Safe(fmt.Sprintf(
+			"staged cluster version %s does not match requested commit version %s", stagedCV.Version, *req.Version)))
+	}
+
+	// Re-validate the version against the binary's supported range, exactly
+	// as ValidateTargetClusterVersion/PrecheckClusterVersion would: staging
+	// happened some time ago, potentially against a different binary.
+	if stagedCV.Version.Less(versionSetting.BinaryMinSupportedVersion()) || versionSetting.BinaryVersion().Less(stagedCV.Version) {
+		return nil, errors.Newf("%s", redact.Safe(fmt.Sprintf(
+			"staged version %s is outside this binary's supported range [%s, %s]",
+			stagedCV.Version, versionSetting.BinaryMinSupportedVersion(), versionSetting.BinaryVersion())))
+	}
+
+	newCV := clusterversion.ClusterVersion{Version: stagedCV.Version}
+
+	// This rename is what makes the bump durable and atomic from the
+	// perspective of a node restarting mid-commit: either the active file
+	// reflects the old version (we crashed before the rename) or the new one
+	// (we crashed after), never a torn write.
+	if err := kvserver.ActivateStagedClusterVersionOnEngines(ctx, m.server.engines, newCV); err != nil {
+		return nil, err
+	}
+
+	if err := m.server.ClusterSettings().Version.SetActiveVersion(ctx, newCV); err != nil {
+		return nil, err
+	}
+
+	return &serverpb.CommitClusterVersionResponse{}, nil
+}
+
+// AbortClusterVersion implements the MigrationServer interface. It discards
+// a version previously staged by PrepareClusterVersion without ever
+// activating it, for use when some other node in the fan-out failed to
+// prepare.
+func (m *migrationServer) AbortClusterVersion(
+	ctx context.Context, req *serverpb.AbortClusterVersionRequest,
+) (*serverpb.AbortClusterVersionResponse, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	versionSetting := m.server.ClusterSettings().Version
+	prevCV, err := kvserver.SynthesizeClusterVersionFromEngines(
+		ctx, m.server.engines, versionSetting.BinaryVersion(),
+		versionSetting.BinaryMinSupportedVersion(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := migrationSignaturePayload(m.server.ClusterID().String(), prevCV.Version.String(), req.Version.String(), req.Nonce)
+	if err := verifyMigrationSignature(ctx, m.server.engines, &versionSetting.SV, req.KeyId, req.Nonce, payload, req.Signature); err != nil {
+		log.Warningf(ctx, "rejecting unsigned or mis-signed cluster version abort: %v", err)
+		return nil, err
+	}
+
+	if err := kvserver.DiscardStagedClusterVersionFromEngines(ctx, m.server.engines); err != nil {
+		return nil, err
+	}
+
+	return &serverpb.AbortClusterVersionResponse{}, nil
+}
+
+// RollbackClusterVersion implements the MigrationServer interface. It steps
+// the persisted cluster version back to a prior version, provided every
+// migration registered for a version in (target, current] declares itself
+// rollback-safe. This is the only supported way back for an operator whose
+// finalization failed partway through; before this RPC existed, there was
+// none.
+//
+// Migrations are rolled back in reverse version order, i.e. the most
+// recently applied migration first. If req.DryRun is set, no migration's
+// Rollback hook is invoked and no engine is touched; the response merely
+// reports which migrations, if any, would block the rollback.
+func (m *migrationServer) RollbackClusterVersion(
+	ctx context.Context, req *serverpb.RollbackClusterVersionRequest,
+) (*serverpb.RollbackClusterVersionResponse, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	versionSetting := m.server.ClusterSettings().Version
+	prevCV, err := kvserver.SynthesizeClusterVersionFromEngines(
+		ctx, m.server.engines, versionSetting.BinaryVersion(),
+		versionSetting.BinaryMinSupportedVersion(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	targetVersion := *req.Version
+	if targetVersion.Less(versionSetting.BinaryMinSupportedVersion()) {
+		return nil, errors.Newf("%s", redact.Safe(fmt.Sprintf(
+			"cannot roll back below binary's min supported version %s", versionSetting.BinaryMinSupportedVersion())))
+	}
+	if !targetVersion.Less(prevCV.Version) {
+		// Nothing to do; we're already at or below the target version.
+		return &serverpb.RollbackClusterVersionResponse{}, nil
+	}
+
+	// A dry run doesn't mutate anything, so it doesn't need to carry a
+	// trusted signature; an actual rollback does, for the same reason an
+	// actual bump does.
+	if !req.DryRun {
+		payload := migrationSignaturePayload(m.server.ClusterID().String(), prevCV.Version.String(), targetVersion.String(), req.Nonce)
+		if err := verifyMigrationSignature(ctx, m.server.engines, &versionSetting.SV, req.KeyId, req.Nonce, payload, req.Signature); err != nil {
+			log.Warningf(ctx, "rejecting unsigned or mis-signed cluster version rollback: %v", err)
+			return nil, err
+		}
+	}
+
+	toRollBack := migrations.RegisteredMigrations(targetVersion, prevCV.Version)
+
+	var blocking []string
+	for i := len(toRollBack) - 1; i >= 0; i-- {
+		if toRollBack[i].Rollback == nil {
+			blocking = append(blocking, toRollBack[i].Version.String())
+		}
+	}
+	if len(blocking) > 0 {
+		return &serverpb.RollbackClusterVersionResponse{BlockingMigrations: blocking}, nil
+	}
+
+	if req.DryRun {
+		return &serverpb.RollbackClusterVersionResponse{}, nil
+	}
+
+	for i := len(toRollBack) - 1; i >= 0; i-- {
+		if err := toRollBack[i].Rollback(ctx); err != nil {
+			return nil, errors.Wrapf(err, "rolling back migration for %s", toRollBack[i].Version)
+		}
+	}
+
+	newCV := clusterversion.ClusterVersion{Version: targetVersion}
+	if err := kvserver.WriteClusterVersionToEngines(ctx, m.server.engines, newCV); err != nil {
+		return nil, err
+	}
+
+	// Without this, the in-memory version gate stays at the version we just
+	// rolled back from until the node restarts, so the rollback wouldn't
+	// actually take effect despite being durably persisted.
+	if err := versionSetting.SetActiveVersion(ctx, newCV); err != nil {
+		return nil, err
+	}
+
+	return &serverpb.RollbackClusterVersionResponse{}, nil
+}
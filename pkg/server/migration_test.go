@@ -0,0 +1,269 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package server_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/migrations"
+	"github.com/cockroachdb/cockroach/pkg/rpc"
+	"github.com/cockroachdb/cockroach/pkg/server/serverpb"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+func startMigrationClient(
+	t *testing.T, ctx context.Context, s serverutils.TestServerInterface,
+) serverpb.MigrationClient {
+	conn, err := s.RPCContext().GRPCDialNode(s.ServingRPCAddr(), s.NodeID(), rpc.DefaultClass).Connect(ctx)
+	require.NoError(t, err)
+	return serverpb.NewMigrationClient(conn)
+}
+
+// TestPrepareCommitClusterVersion exercises the two-phase bump's happy
+// path: prepare stages a version without activating it, and commit activates
+// exactly what was staged.
+func TestPrepareCommitClusterVersion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, _, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	client := startMigrationClient(t, ctx, s)
+
+	before := s.ClusterSettings().Version.ActiveVersion(ctx).Version
+	target := before
+	target.Internal++
+
+	_, err := client.PrepareClusterVersion(ctx, &serverpb.PrepareClusterVersionRequest{Version: &target})
+	require.NoError(t, err)
+
+	// Staging alone must not move the active version.
+	require.Equal(t, before, s.ClusterSettings().Version.ActiveVersion(ctx).Version)
+
+	_, err = client.CommitClusterVersion(ctx, &serverpb.CommitClusterVersionRequest{Version: &target})
+	require.NoError(t, err)
+	require.Equal(t, target, s.ClusterSettings().Version.ActiveVersion(ctx).Version)
+}
+
+// TestAbortClusterVersionDiscardsStage verifies that an aborted prepare never
+// takes effect.
+func TestAbortClusterVersionDiscardsStage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, _, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	client := startMigrationClient(t, ctx, s)
+
+	before := s.ClusterSettings().Version.ActiveVersion(ctx).Version
+	target := before
+	target.Internal++
+
+	_, err := client.PrepareClusterVersion(ctx, &serverpb.PrepareClusterVersionRequest{Version: &target})
+	require.NoError(t, err)
+
+	_, err = client.AbortClusterVersion(ctx, &serverpb.AbortClusterVersionRequest{Version: &target})
+	require.NoError(t, err)
+
+	_, err = client.CommitClusterVersion(ctx, &serverpb.CommitClusterVersionRequest{Version: &target})
+	require.Error(t, err, "commit should fail once the stage has been aborted")
+	require.Equal(t, before, s.ClusterSettings().Version.ActiveVersion(ctx).Version)
+}
+
+// TestReconcileStagedClusterVersionWithoutQuorumDiscardsStage simulates the
+// crash-recovery interleaving: a version is staged (as if by a node that
+// then crashed before committing), and restarting the node against the same
+// store -- the same path a real crash-and-restart takes, reconciling via
+// newMigrationServer during Server.Start before the Migration service ever
+// accepts an RPC -- discards the stage with no quorum ack, rather than
+// silently leaving it around.
+func TestReconcileStagedClusterVersionWithoutQuorumDiscardsStage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	storeSpec := base.DefaultTestStoreSpec
+	storeSpec.Path = t.TempDir()
+	args := base.TestServerArgs{StoreSpecs: []base.StoreSpec{storeSpec}}
+
+	s, _, _ := serverutils.StartServer(t, args)
+	client := startMigrationClient(t, ctx, s)
+
+	before := s.ClusterSettings().Version.ActiveVersion(ctx).Version
+	target := before
+	target.Internal++
+
+	_, err := client.PrepareClusterVersion(ctx, &serverpb.PrepareClusterVersionRequest{Version: &target})
+	require.NoError(t, err)
+
+	// Stop the node without ever committing, the way a crash would, then
+	// restart it against the very same store.
+	s.Stopper().Stop(ctx)
+	s, _, _ = serverutils.StartServer(t, args)
+	defer s.Stopper().Stop(ctx)
+
+	// No quorum committed in this test cluster, so reconciliation -- run
+	// as part of the restart above, not invoked directly by this test --
+	// should have discarded the stage, and a subsequent commit attempt
+	// should fail.
+	client = startMigrationClient(t, ctx, s)
+	_, err = client.CommitClusterVersion(ctx, &serverpb.CommitClusterVersionRequest{Version: &target})
+	require.Error(t, err)
+	require.Equal(t, before, s.ClusterSettings().Version.ActiveVersion(ctx).Version)
+}
+
+// TestPrecheckClusterVersionReportsNoFindingsOnCleanServer verifies that
+// PrecheckClusterVersion succeeds with an empty findings list when there is
+// nothing to report.
+func TestPrecheckClusterVersionReportsNoFindingsOnCleanServer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, _, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	client := startMigrationClient(t, ctx, s)
+
+	// Target the version the server already runs, which lies inside its
+	// binary's supported range; anything above the binary version would be
+	// reported as an out-of-range finding.
+	target := s.ClusterSettings().Version.ActiveVersion(ctx).Version
+
+	resp, err := client.PrecheckClusterVersion(ctx, &serverpb.PrecheckClusterVersionRequest{Version: &target})
+	require.NoError(t, err)
+
+	// A freshly started single-node test server has nothing to report: no
+	// deprecated encodings, no in-flight schema changes, replication factor
+	// trivially satisfied, no lagging engines, and a target inside the
+	// binary's supported range. The RPC should still
+	// succeed rather than erroring out on the first thing it checks.
+	require.Empty(t, resp.Findings)
+}
+
+// TestBumpClusterVersionRejectsUnsignedRequestOnceKeysConfigured verifies
+// that once an operator configures server.migration.trusted_keys, a bump
+// request carrying no (or a bogus) signature is rejected rather than
+// silently applied.
+func TestBumpClusterVersionRejectsUnsignedRequestOnceKeysConfigured(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, sqlDB, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	pub, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	_, err = sqlDB.ExecContext(ctx, `SET CLUSTER SETTING server.migration.trusted_keys = $1`, string(keyPEM))
+	require.NoError(t, err)
+
+	target := s.ClusterSettings().Version.ActiveVersion(ctx).Version
+	target.Internal++
+
+	client := startMigrationClient(t, ctx, s)
+	_, err = client.BumpClusterVersion(ctx, &serverpb.BumpClusterVersionRequest{Version: &target})
+	require.Error(t, err, "an unsigned request must be rejected once trusted keys are configured")
+}
+
+// TestRollbackClusterVersionDryRunReportsBlockingMigrations verifies that a
+// dry-run rollback past a migration with no Rollback hook is reported as
+// blocked rather than either silently succeeding or silently no-op'ing.
+func TestRollbackClusterVersionDryRunReportsBlockingMigrations(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, _, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	client := startMigrationClient(t, ctx, s)
+
+	current := s.ClusterSettings().Version.ActiveVersion(ctx).Version
+	target := current
+	target.Internal -= 2 // roll back past every registered migration, rollback-safe or not
+
+	// Register a migration inside the targeted window with no Rollback hook.
+	blocker := current
+	blocker.Internal--
+	migrations.Register(migrations.Registration{Version: blocker})
+
+	resp, err := client.RollbackClusterVersion(ctx, &serverpb.RollbackClusterVersionRequest{
+		Version: &target,
+		DryRun:  true,
+	})
+	require.NoError(t, err)
+
+	// The migration registered above has no Rollback hook and lies in the
+	// targeted window; the dry run must name it rather than pretend the
+	// rollback is safe.
+	require.NotEmpty(t, resp.BlockingMigrations)
+	require.Equal(t, current, s.ClusterSettings().Version.ActiveVersion(ctx).Version, "a dry run must not mutate the active version")
+}
+
+// TestBumpClusterVersionStreamEmitsProgressPerEngine verifies that the
+// streaming form of BumpClusterVersion emits at least one progress event per
+// engine and a final DONE event, rather than staying silent until the whole
+// bump completes.
+func TestBumpClusterVersionStreamEmitsProgressPerEngine(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, _, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	conn, err := s.RPCContext().GRPCDialNode(s.ServingRPCAddr(), s.NodeID(), rpc.DefaultClass).Connect(ctx)
+	require.NoError(t, err)
+	client := serverpb.NewMigrationClient(conn)
+
+	target := s.ClusterSettings().Version.ActiveVersion(ctx).Version
+	target.Internal++
+
+	stream, err := client.BumpClusterVersionStream(ctx, &serverpb.BumpClusterVersionRequest{Version: &target})
+	require.NoError(t, err)
+
+	var sawDone bool
+	var engines int
+	for {
+		progress, err := stream.Recv()
+		if err != nil {
+			break
+		}
+		require.Empty(t, progress.Error)
+		switch progress.Stage {
+		case serverpb.ClusterVersionBumpProgress_PERSISTING:
+			engines++
+		case serverpb.ClusterVersionBumpProgress_DONE:
+			sawDone = true
+		}
+	}
+
+	require.True(t, sawDone, "stream must end with a DONE event")
+	require.Positive(t, engines, "stream must report progress for at least one engine")
+	require.Equal(t, target, s.ClusterSettings().Version.ActiveVersion(ctx).Version)
+}